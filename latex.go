@@ -18,6 +18,26 @@ package blackfriday
 import (
 	"bytes"
 	"path/filepath"
+	"strconv"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// LATEX_USE_MINTED makes BlockCode render language-tagged code fences with
+// the minted package (which shells out to Pygments at LaTeX-compile time)
+// instead of lstlisting.
+//
+// LATEX_USE_CHROMA pre-highlights language-tagged code fences at Markdown
+// render time using github.com/alecthomas/chroma, emitting plain colored
+// LaTeX inside a fancyvrb Verbatim block. This avoids the -shell-escape
+// requirement that minted (and LATEX_USE_MINTED) needs. It takes precedence
+// over LATEX_USE_MINTED when both are set and the language is recognized by
+// chroma; unrecognized languages fall through to LATEX_USE_MINTED, then to
+// plain lstlisting.
+const (
+	LATEX_USE_MINTED = 1 << iota
+	LATEX_USE_CHROMA
 )
 
 // Latex is a type that implements the Renderer interface for LaTeX output.
@@ -27,35 +47,112 @@ type Latex struct {
 	flags  int
 	title  string
 	author string
+
+	// footnoteCount tracks how many FootnoteItem entries have been emitted so
+	// far, so that \footnotetext numbers line up with the \footnotemark
+	// numbers written by FootnoteRef.
+	footnoteCount int
+
+	// sawLineBreak is set by LineBreak and consumed by writeTableCell: it is
+	// the only reliable signal that a cell's content actually contains a
+	// hard line break, as opposed to merely containing a backslash (from a
+	// code span, an escaped character, etc.) once escapeSpecialChars has run.
+	sawLineBreak bool
 }
 
 // LatexRenderer creates and configures a Latex object, which
 // satisfies the Renderer interface.
 //
-// flags is a set of LATEX_* options ORed together (currently no such options
-// are defined).
+// flags is a set of LATEX_* options ORed together.
 func LatexRenderer(flags int, title, author string) Renderer {
-	return &Latex{title: title, author: author}
+	return &Latex{flags: flags, title: title, author: author}
 }
 
 func (options *Latex) GetFlags() int {
-	return 0
+	return options.flags
 }
 
-// render code chunks using verbatim, or listings if we have a language
+// render code chunks using verbatim, or listings/minted/chroma if we have a language
 func (options *Latex) BlockCode(out *bytes.Buffer, text []byte, lang string) {
 	if lang == "" {
 		out.WriteString("\n\\begin{verbatim}\n")
-	} else {
-		out.WriteString("\n\\begin{lstlisting}[language=")
+		out.Write(text)
+		out.WriteString("\n\\end{verbatim}\n")
+		return
+	}
+	if options.flags&LATEX_USE_CHROMA != 0 && options.highlightChroma(out, lang, text) {
+		return
+	}
+	if options.flags&LATEX_USE_MINTED != 0 {
+		out.WriteString("\n\\begin{minted}{")
 		out.WriteString(lang)
-		out.WriteString("]\n")
+		out.WriteString("}\n")
+		out.Write(text)
+		out.WriteString("\n\\end{minted}\n")
+		return
 	}
+	out.WriteString("\n\\begin{lstlisting}[language=")
+	out.WriteString(lang)
+	out.WriteString("]\n")
 	out.Write(text)
-	if lang == "" {
-		out.WriteString("\n\\end{verbatim}\n")
-	} else {
-		out.WriteString("\n\\end{lstlisting}\n")
+	out.WriteString("\n\\end{lstlisting}\n")
+}
+
+// highlightChroma pre-highlights text as lang using chroma and writes the
+// result as plain colored LaTeX wrapped in a fancyvrb Verbatim block. It
+// returns false (writing nothing) when chroma has no lexer for lang, so the
+// caller can fall back to minted or lstlisting.
+func (options *Latex) highlightChroma(out *bytes.Buffer, lang string, text []byte) bool {
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		return false
+	}
+	iterator, err := lexer.Tokenise(nil, string(text))
+	if err != nil {
+		return false
+	}
+	style := styles.Get("github")
+	if style == nil {
+		style = styles.Fallback
+	}
+	// commandchars gives \, { and } special meaning inside the Verbatim
+	// block so \textcolor{...}{...} can be emitted around otherwise literal
+	// source; those same three characters must therefore be escaped wherever
+	// they occur in the source itself (escapeVerbatimCommandChars), the same
+	// way Pygments' own LaTeX formatter escapes them as \PYZbs{}/\PYZob{}/\PYZcb{}.
+	out.WriteString("\n\\begin{Verbatim}[commandchars=\\\\\\{\\}]\n")
+	for _, token := range iterator.Tokens() {
+		entry := style.Get(token.Type)
+		if entry.Colour.IsSet() {
+			out.WriteString("\\textcolor[HTML]{")
+			out.WriteString(entry.Colour.String()[1:])
+			out.WriteString("}{")
+			escapeVerbatimCommandChars(out, token.Value)
+			out.WriteString("}")
+		} else {
+			escapeVerbatimCommandChars(out, token.Value)
+		}
+	}
+	out.WriteString("\n\\end{Verbatim}\n")
+	return true
+}
+
+// escapeVerbatimCommandChars escapes the three characters that commandchars
+// makes active inside a fancyvrb Verbatim block (\, { and }), so that raw
+// source text containing them doesn't get misread as our own \textcolor
+// commands.
+func escapeVerbatimCommandChars(out *bytes.Buffer, s string) {
+	for _, r := range s {
+		switch r {
+		case '\\':
+			out.WriteString("\\PYZbs{}")
+		case '{':
+			out.WriteString("\\PYZob{}")
+		case '}':
+			out.WriteString("\\PYZcb{}")
+		default:
+			out.WriteRune(r)
+		}
 	}
 }
 
@@ -102,6 +199,11 @@ func (options *Latex) Header(out *bytes.Buffer, text func() bool, level int, id
 		return
 	}
 	out.WriteString("}\n")
+	if id != "" {
+		out.WriteString("\\label{")
+		out.WriteString(id)
+		out.WriteString("}\n")
+	}
 }
 
 func (options *Latex) HRule(out *bytes.Buffer) {
@@ -141,53 +243,100 @@ func (options *Latex) Paragraph(out *bytes.Buffer, text func() bool) {
 	out.WriteString("\n")
 }
 
+// cellAlignChar returns the tabular column-spec letter for a TABLE_ALIGNMENT_* value.
+func cellAlignChar(align int) byte {
+	switch align {
+	case TABLE_ALIGNMENT_LEFT:
+		return 'l'
+	case TABLE_ALIGNMENT_RIGHT:
+		return 'r'
+	default:
+		return 'c'
+	}
+}
+
 func (options *Latex) Table(out *bytes.Buffer, header []byte, body []byte, columnData []int) {
 	out.WriteString("\n\\begin{tabular}{")
 	for _, elt := range columnData {
-		switch elt {
-		case TABLE_ALIGNMENT_LEFT:
-			out.WriteByte('l')
-		case TABLE_ALIGNMENT_RIGHT:
-			out.WriteByte('r')
-		default:
-			out.WriteByte('c')
-		}
+		out.WriteByte(cellAlignChar(elt))
 	}
-	out.WriteString("}\n")
+	out.WriteString("}\n\\toprule\n")
 	out.Write(header)
-	out.WriteString(" \\\\\n\\hline\n")
+	out.WriteString("\\midrule\n")
 	out.Write(body)
-	out.WriteString("\n\\end{tabular}\n")
+	out.WriteString("\\bottomrule\n\\end{tabular}\n")
 }
 
+// TableRow always terminates the row it is given, rather than prepending a
+// separator when out already has content: out keeps accumulating across the
+// header row and every body row of the same table, so checking out.Len() > 0
+// to detect "not the first row" is true again as soon as the header has been
+// written, producing a spurious extra \\ before the first body row.
 func (options *Latex) TableRow(out *bytes.Buffer, text []byte) {
-	if out.Len() > 0 {
-		out.WriteString(" \\\\\n")
-	}
 	out.Write(text)
+	out.WriteString(" \\\\\n")
 }
 
-func (options *Latex) TableHeaderCell(out *bytes.Buffer, text []byte, align int) {
-	if out.Len() > 0 {
+// writeTableCell wraps a cell's content so its own alignment is honored
+// regardless of the column's default spec, via \multicolumn, and so content
+// containing an actual hard line break lays out cleanly via \makecell. The
+// out.Len() > 0 check below detects "not the first cell in this row" because
+// each row is built into its own fresh scratch buffer. The first cell of a
+// row is never wrapped in \makecell, since sawLineBreak is cleared there.
+func (options *Latex) writeTableCell(out *bytes.Buffer, text []byte, align int) {
+	firstInRow := out.Len() == 0
+	if firstInRow {
+		// A cell's own content can never itself trigger a hard line break
+		// (rows are rendered from a single source line), so any sawLineBreak
+		// seen here must be a stale leftover from unrelated content earlier
+		// in the document; clear it before it gets misattributed to this row.
+		options.sawLineBreak = false
+	} else {
 		out.WriteString(" & ")
 	}
-	out.Write(text)
+	content := text
+	if options.sawLineBreak {
+		options.sawLineBreak = false
+		var wrapped bytes.Buffer
+		wrapped.WriteString("\\makecell[")
+		wrapped.WriteByte(cellAlignChar(align))
+		wrapped.WriteString("]{")
+		wrapped.Write(text)
+		wrapped.WriteString("}")
+		content = wrapped.Bytes()
+	}
+	out.WriteString("\\multicolumn{1}{")
+	out.WriteByte(cellAlignChar(align))
+	out.WriteString("}{")
+	out.Write(content)
+	out.WriteString("}")
+}
+
+func (options *Latex) TableHeaderCell(out *bytes.Buffer, text []byte, align int) {
+	options.writeTableCell(out, text, align)
 }
 
 func (options *Latex) TableCell(out *bytes.Buffer, text []byte, align int) {
-	if out.Len() > 0 {
-		out.WriteString(" & ")
-	}
-	out.Write(text)
+	options.writeTableCell(out, text, align)
 }
 
-// TODO: this
+// Footnotes collects the rendered FootnoteItem entries (via text) and emits
+// them as \footnotetext blocks, matching the numbering used by FootnoteRef.
 func (options *Latex) Footnotes(out *bytes.Buffer, text func() bool) {
-
+	marker := out.Len()
+	out.WriteString("\n")
+	if !text() {
+		out.Truncate(marker)
+	}
 }
 
 func (options *Latex) FootnoteItem(out *bytes.Buffer, name, text []byte, flags int) {
-
+	options.footnoteCount++
+	out.WriteString("\\footnotetext[")
+	out.WriteString(strconv.Itoa(options.footnoteCount))
+	out.WriteString("]{")
+	out.Write(text)
+	out.WriteString("}\n")
 }
 
 func (options *Latex) AutoLink(out *bytes.Buffer, link []byte, kind int) {
@@ -246,10 +395,22 @@ func (options *Latex) Image(out *bytes.Buffer, link []byte, title []byte, alt []
 }
 
 func (options *Latex) LineBreak(out *bytes.Buffer) {
+	options.sawLineBreak = true
 	out.WriteString(" \\\\\n")
 }
 
 func (options *Latex) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+	if bytes.HasPrefix(link, []byte("#")) {
+		// An internal anchor: route through \hyperref so the link survives
+		// LaTeX's own cross-referencing instead of relying on a PDF-only
+		// named destination, which \href{#id}{...} does not produce.
+		out.WriteString("\\hyperref[")
+		out.Write(link[1:])
+		out.WriteString("]{")
+		out.Write(content)
+		out.WriteString("}")
+		return
+	}
 	out.WriteString("\\href{")
 	out.Write(link)
 	out.WriteString("}{")
@@ -272,9 +433,12 @@ func (options *Latex) StrikeThrough(out *bytes.Buffer, text []byte) {
 	out.WriteString("}")
 }
 
-// TODO: this
+// FootnoteRef marks the reference site with \footnotemark, using the same
+// numbering (id) that the HTML renderer assigns to the matching FootnoteItem.
 func (options *Latex) FootnoteRef(out *bytes.Buffer, ref []byte, id int) {
-
+	out.WriteString("\\footnotemark[")
+	out.WriteString(strconv.Itoa(id))
+	out.WriteString("]")
 }
 
 func needsBackslash(c byte) bool {
@@ -307,9 +471,77 @@ func escapeSpecialChars(out *bytes.Buffer, text []byte) {
 	}
 }
 
+// latexEntityReplacements maps the HTML entities blackfriday commonly emits
+// (named references, written out exactly as "&name;") to either a LaTeX
+// command producing the equivalent glyph or, where a plain character is
+// enough, the character itself.
+var latexEntityReplacements = map[string]string{
+	"&amp;":    "\\&",
+	"&lt;":     "\\textless{}",
+	"&gt;":     "\\textgreater{}",
+	"&quot;":   "''",
+	"&apos;":   "'",
+	"&nbsp;":   "~",
+	"&mdash;":  "---",
+	"&ndash;":  "--",
+	"&hellip;": "\\ldots{}",
+	"&copy;":   "\\textcopyright{}",
+	"&reg;":    "\\textregistered{}",
+	"&trade;":  "\\texttrademark{}",
+	"&sect;":   "\\S{}",
+	"&para;":   "\\P{}",
+	"&deg;":    "\\textdegree{}",
+	"&laquo;":  "\\guillemotleft{}",
+	"&raquo;":  "\\guillemotright{}",
+	"&ldquo;":  "``",
+	"&rdquo;":  "''",
+	"&lsquo;":  "`",
+	"&rsquo;":  "'",
+	"&euro;":   "\\EUR{}",
+	"&plusmn;": "\\textpm{}",
+	"&times;":  "\\texttimes{}",
+	"&divide;": "\\textdiv{}",
+}
+
+// decodeNumericEntity parses a "&#123;" or "&#x7B;" character reference into
+// its codepoint.
+func decodeNumericEntity(entity []byte) (rune, bool) {
+	if len(entity) < 4 || entity[0] != '&' || entity[1] != '#' || entity[len(entity)-1] != ';' {
+		return 0, false
+	}
+	body := entity[2 : len(entity)-1]
+	base := 10
+	if len(body) > 0 && (body[0] == 'x' || body[0] == 'X') {
+		base = 16
+		body = body[1:]
+	}
+	n, err := strconv.ParseInt(string(body), base, 32)
+	if err != nil {
+		return 0, false
+	}
+	return rune(n), true
+}
+
 func (options *Latex) Entity(out *bytes.Buffer, entity []byte) {
-	// TODO: convert this into a unicode character or something
-	out.Write(entity)
+	if repl, ok := latexEntityReplacements[string(entity)]; ok {
+		out.WriteString(repl)
+		return
+	}
+	if r, ok := decodeNumericEntity(entity); ok {
+		// A numeric reference can decode to a character LaTeX treats
+		// specially (e.g. &#36; is a literal "$"), so it still has to go
+		// through the same escaping as any other text. Otherwise rely on
+		// the \DeclareUnicodeCharacter entries in DocumentHeader (plus
+		// LaTeX's native UTF-8 support) to typeset the codepoint.
+		if r < 128 && needsBackslash(byte(r)) {
+			out.WriteByte('\\')
+		}
+		out.WriteRune(r)
+		return
+	}
+	// Unknown entity: escape it as plain text rather than writing the raw
+	// "&...;" straight through, which LaTeX would choke on at the "&".
+	escapeSpecialChars(out, entity)
 }
 
 func (options *Latex) NormalText(out *bytes.Buffer, text []byte) {
@@ -340,7 +572,19 @@ func (options *Latex) DocumentHeader(out *bytes.Buffer) {
 \usepackage{verbatim}
 \usepackage[normalem]{ulem}
 \usepackage{hyperref}
-
+\usepackage{booktabs}
+\usepackage{makecell}
+\usepackage{tabularx}
+`)
+	if options.flags&LATEX_USE_MINTED != 0 {
+		out.WriteString("\\usepackage{minted}\n")
+	}
+	if options.flags&LATEX_USE_CHROMA != 0 {
+		out.WriteString("\\usepackage{fancyvrb}\n\\usepackage{xcolor}\n")
+		// the escapes written by escapeVerbatimCommandChars
+		out.WriteString("\\def\\PYZbs{\\char`\\\\}\n\\def\\PYZob{\\char`\\{}\n\\def\\PYZcb{\\char`\\}}\n")
+	}
+	out.WriteString(`
 \title{`)
 	options.NormalText(out, []byte(options.title))
 	out.WriteString(`}